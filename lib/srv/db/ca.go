@@ -0,0 +1,161 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gravitational/teleport/api/types"
+
+	"github.com/gravitational/trace"
+)
+
+// CADownloader fetches a database's CA cert from its cloud provider so it
+// can be used to verify TLS connections to the upstream database.
+type CADownloader interface {
+	// Download fetches database's CA cert and stores it in the configured
+	// CAStore. It does not check whether the store already holds a cert for
+	// database; downloadCACert does that before calling it.
+	Download(ctx context.Context, database types.Database) error
+}
+
+// realDownloader is the production CADownloader. It persists certs through
+// a CAStore rather than directly to local disk, so that all db-service
+// replicas behind a load balancer converge on the same cert instead of
+// downloading and caching their own copies independently.
+type realDownloader struct {
+	store CAStore
+}
+
+// NewRealDownloader returns a CADownloader that persists downloaded certs
+// to store.
+func NewRealDownloader(store CAStore) CADownloader {
+	return &realDownloader{store: store}
+}
+
+// caDownloadURLs maps database types to the URL serving their root CA cert
+// bundle. Databases with a statically configured CA (or of a type that
+// doesn't require one, e.g. self-hosted) are absent from this map.
+var caDownloadURLs = map[string]string{
+	types.DatabaseTypeRDS:      "https://truststore.pki.rds.amazonaws.com/global/global-bundle.pem",
+	types.DatabaseTypeCloudSQL: "https://storage.googleapis.com/cloudsql-proxy/info/cloudsql-root.pem",
+}
+
+func (d *realDownloader) Download(ctx context.Context, database types.Database) error {
+	url, ok := caDownloadURLs[database.GetType()]
+	if !ok {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return trace.BadParameter("failed to download CA cert for %v: status code %v", database, resp.StatusCode)
+	}
+	cert, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(d.store.Put(ctx, database.GetName(), caFingerprint(cert), cert))
+}
+
+// caFingerprint returns the hex-encoded SHA256 of cert, used as its key in
+// a CAStore so that a rotated CA is stored alongside (rather than
+// overwriting) the CA it replaces.
+func caFingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+	return hex.EncodeToString(sum[:])
+}
+
+// initCACert makes sure the CA cert used to verify TLS connections to
+// database is available in the configured CAStore, downloading it first
+// if necessary, then starts watching for rotations performed by other
+// db-service replicas sharing the store.
+func (s *Server) initCACert(ctx context.Context, database types.Database) error {
+	if database.GetCA() != "" {
+		return nil
+	}
+	fingerprints, err := s.cfg.CAStore.List(ctx, database.GetName())
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if len(fingerprints) == 0 {
+		if err := s.downloadCACert(ctx, database); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+	s.watchCACertRotation(database)
+	return nil
+}
+
+// downloadCACert downloads database's CA cert, coordinating with other
+// db-service replicas sharing the CAStore (if it supports that) so that
+// only one of them downloads it at a time.
+func (s *Server) downloadCACert(ctx context.Context, database types.Database) error {
+	download := func() error {
+		// Re-check the store now that we hold the lock (or, if the store
+		// doesn't coordinate downloads, for consistency with the
+		// coordinated path): another replica may have already downloaded
+		// the cert while we were waiting, in which case there's nothing
+		// left to do.
+		fingerprints, err := s.cfg.CAStore.List(ctx, database.GetName())
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if len(fingerprints) > 0 {
+			return nil
+		}
+		s.log.Debugf("Downloading CA cert for %v.", database)
+		return trace.Wrap(s.cfg.CADownloader.Download(ctx, database))
+	}
+	if coordinator, ok := s.cfg.CAStore.(DownloadCoordinator); ok {
+		return trace.Wrap(coordinator.WithDownloadLock(ctx, database.GetName(), download))
+	}
+	return trace.Wrap(download())
+}
+
+// watchCACertRotation starts a background goroutine that applies CA cert
+// rotations performed by other db-service replicas to database via
+// SetStatusCA, for CAStores that support it. It's a no-op for CAStores
+// with no peers to watch (e.g. the local filesystem store). The watch
+// runs for the lifetime of the server, not just this call, since a
+// rotation can happen at any point after startup.
+func (s *Server) watchCACertRotation(database types.Database) {
+	coordinator, ok := s.cfg.CAStore.(DownloadCoordinator)
+	if !ok {
+		return
+	}
+	go func() {
+		err := coordinator.WatchLatest(s.closeContext, database.GetName(), func(fingerprint string, cert []byte) {
+			database.SetStatusCA(string(cert))
+			s.log.Debugf("Picked up rotated CA cert %v for %v.", fingerprint, database)
+		})
+		if err != nil && s.closeContext.Err() == nil {
+			s.log.WithError(err).Warnf("CA cert watch for %v exited.", database)
+		}
+	}()
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+)
+
+// CAStore persists downloaded database CA certificates (e.g. RDS and Cloud
+// SQL root certs) so they can be shared by every db-service replica fronted
+// by a load balancer, instead of each replica downloading and caching its
+// own copy on local disk.
+//
+// Certs are keyed by database name and fingerprint (the SHA256 of the cert
+// body) so that rotating a database's CA produces a new key rather than
+// overwriting the old one, letting in-flight connections that still trust
+// the old CA keep working until they're closed.
+type CAStore interface {
+	// Get returns the previously stored cert for the given database name
+	// and fingerprint. Returns a trace.NotFound error if it isn't present.
+	Get(ctx context.Context, databaseName, fingerprint string) ([]byte, error)
+	// Put stores cert under the given database name and fingerprint.
+	Put(ctx context.Context, databaseName, fingerprint string, cert []byte) error
+	// List returns the fingerprints currently stored for databaseName.
+	List(ctx context.Context, databaseName string) ([]string, error)
+	// Delete removes the cert stored under the given database name and
+	// fingerprint.
+	Delete(ctx context.Context, databaseName, fingerprint string) error
+}
+
+// DownloadCoordinator is implemented by CAStores that can coordinate CA
+// cert downloads across every db-service replica sharing the store.
+// CAStores with no peers to coordinate with (e.g. the local filesystem
+// store) don't need to implement it; callers should fall back to
+// downloading without a lock when a CAStore doesn't satisfy this
+// interface.
+type DownloadCoordinator interface {
+	// WithDownloadLock runs fn while holding a cluster-wide lock keyed by
+	// databaseName, so that only one replica downloads a given database's
+	// CA cert at a time.
+	WithDownloadLock(ctx context.Context, databaseName string, fn func() error) error
+	// WatchLatest calls onUpdate with the newest cert fingerprint and body
+	// whenever another replica rotates databaseName's CA. Blocks until ctx
+	// is canceled.
+	WatchLatest(ctx context.Context, databaseName string, onUpdate func(fingerprint string, cert []byte)) error
+}
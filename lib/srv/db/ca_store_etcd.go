@@ -0,0 +1,218 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"path"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+)
+
+// etcdCALeaseTTL is how long a stored cert's lease lives for before it must
+// be refreshed by the replica that owns it. Refreshed well before expiry so
+// a brief network blip doesn't cause the cert to be evicted.
+const etcdCALeaseTTL = 5 * time.Minute
+
+// EtcdCAStoreConfig configures an etcd-backed CAStore.
+type EtcdCAStoreConfig struct {
+	// Addrs is the list of etcd endpoints.
+	Addrs []string
+	// Prefix is the etcd key prefix certs are stored under.
+	Prefix string
+	// TLS is the TLS config used to connect to etcd.
+	TLS *tls.Config
+	// Username and Password configure etcd auth, if the cluster requires
+	// it. Both may be empty to disable auth.
+	Username string
+	Password string
+	// DialTimeout bounds how long to wait for the initial connection to
+	// etcd. Defaults to 5 seconds.
+	DialTimeout time.Duration
+}
+
+func (c *EtcdCAStoreConfig) checkAndSetDefaults() error {
+	if len(c.Addrs) == 0 {
+		return trace.BadParameter("missing Addrs in etcd CAStore config")
+	}
+	if c.Prefix == "" {
+		c.Prefix = "/teleport/db/cas"
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 5 * time.Second
+	}
+	return nil
+}
+
+// etcdCAStore is a CAStore backed by etcd, used so that every db-service
+// replica behind a load balancer observes the same set of downloaded CA
+// certs without needing shared local disk.
+type etcdCAStore struct {
+	cfg    EtcdCAStoreConfig
+	client *clientv3.Client
+	log    *logrus.Entry
+}
+
+// NewEtcdCAStore connects to etcd and returns a CAStore backed by it.
+func NewEtcdCAStore(cfg EtcdCAStoreConfig) (CAStore, error) {
+	if err := cfg.checkAndSetDefaults(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   cfg.Addrs,
+		TLS:         cfg.TLS,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		DialTimeout: cfg.DialTimeout,
+	})
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &etcdCAStore{
+		cfg:    cfg,
+		client: client,
+		log:    logrus.WithField(trace.Component, "db:cas:etcd"),
+	}, nil
+}
+
+func (s *etcdCAStore) key(databaseName, fingerprint string) string {
+	return path.Join(s.cfg.Prefix, databaseName, fingerprint)
+}
+
+// latestKey is a per-database pointer holding the fingerprint of the most
+// recently stored cert. Watching this key (rather than a specific
+// fingerprint's key) is what lets WatchLatest observe a rotation to a
+// brand-new fingerprint, not just changes to a cert that's already known.
+func (s *etcdCAStore) latestKey(databaseName string) string {
+	return path.Join(s.cfg.Prefix, databaseName, "latest")
+}
+
+func (s *etcdCAStore) Get(ctx context.Context, databaseName, fingerprint string) ([]byte, error) {
+	resp, err := s.client.Get(ctx, s.key(databaseName, fingerprint))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, trace.NotFound("no cached CA cert for database %q fingerprint %q", databaseName, fingerprint)
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+// Put stores cert under a lease that this replica refreshes for as long as
+// the process is alive. It also updates the latest-fingerprint pointer,
+// which other replicas watch (see WatchLatest) so they pick up the new
+// cert without needing to restart.
+func (s *etcdCAStore) Put(ctx context.Context, databaseName, fingerprint string, cert []byte) error {
+	lease, err := s.client.Grant(ctx, int64(etcdCALeaseTTL.Seconds()))
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := s.client.Put(ctx, s.key(databaseName, fingerprint), string(cert), clientv3.WithLease(lease.ID)); err != nil {
+		return trace.Wrap(err)
+	}
+	// Update the latest-fingerprint pointer so WatchLatest observes the
+	// rotation even though it's a different key (and therefore a
+	// different watch event) than the cert itself.
+	if _, err := s.client.Put(ctx, s.latestKey(databaseName), fingerprint); err != nil {
+		return trace.Wrap(err)
+	}
+	keepAlive, err := s.client.KeepAlive(ctx, lease.ID)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	go func() {
+		for range keepAlive {
+			// Drain keepalive responses for the lifetime of ctx; etcd
+			// client handles the actual refresh cadence.
+		}
+	}()
+	return nil
+}
+
+func (s *etcdCAStore) List(ctx context.Context, databaseName string) ([]string, error) {
+	prefix := path.Join(s.cfg.Prefix, databaseName) + "/"
+	resp, err := s.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	fingerprints := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		// The latest-fingerprint pointer lives under the same prefix but
+		// isn't a stored cert.
+		if string(kv.Key) == s.latestKey(databaseName) {
+			continue
+		}
+		fingerprints = append(fingerprints, path.Base(string(kv.Key)))
+	}
+	return fingerprints, nil
+}
+
+func (s *etcdCAStore) Delete(ctx context.Context, databaseName, fingerprint string) error {
+	_, err := s.client.Delete(ctx, s.key(databaseName, fingerprint))
+	return trace.Wrap(err)
+}
+
+// WatchLatest notifies onUpdate with the newest fingerprint and cert body
+// for databaseName whenever its latest-fingerprint pointer is written,
+// i.e. on every Put for databaseName by any replica, this one included,
+// and whether or not the fingerprint was already known. Blocks until ctx
+// is canceled.
+func (s *etcdCAStore) WatchLatest(ctx context.Context, databaseName string, onUpdate func(fingerprint string, cert []byte)) error {
+	watch := s.client.Watch(ctx, s.latestKey(databaseName))
+	for resp := range watch {
+		if err := resp.Err(); err != nil {
+			return trace.Wrap(err)
+		}
+		for _, event := range resp.Events {
+			if event.Type != clientv3.EventTypePut {
+				continue
+			}
+			fingerprint := string(event.Kv.Value)
+			cert, err := s.Get(ctx, databaseName, fingerprint)
+			if err != nil {
+				s.log.WithError(err).Warnf("Failed to fetch rotated CA cert %v for %v.", fingerprint, databaseName)
+				continue
+			}
+			onUpdate(fingerprint, cert)
+		}
+	}
+	return ctx.Err()
+}
+
+// WithDownloadLock runs fn while holding a cluster-wide etcd mutex keyed by
+// databaseName, so that only one replica downloads a given database's CA
+// cert from its cloud provider at a time.
+func (s *etcdCAStore) WithDownloadLock(ctx context.Context, databaseName string, fn func() error) error {
+	session, err := concurrency.NewSession(s.client)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer session.Close()
+
+	mutex := concurrency.NewMutex(session, path.Join(s.cfg.Prefix, "locks", databaseName))
+	if err := mutex.Lock(ctx); err != nil {
+		return trace.Wrap(err)
+	}
+	defer mutex.Unlock(ctx)
+
+	return fn()
+}
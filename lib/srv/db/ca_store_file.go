@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/gravitational/trace"
+)
+
+// fileCAStore is a CAStore backed by the local filesystem. It is the
+// default when db-service is not configured with a shared backend, and
+// matches the original pre-CAStore behavior of caching certs under
+// DataDir.
+type fileCAStore struct {
+	// dataDir is the directory certs are stored under, normally the
+	// db-service's DataDir.
+	dataDir string
+}
+
+// NewFileCAStore returns a CAStore that persists certs under dataDir.
+func NewFileCAStore(dataDir string) CAStore {
+	return &fileCAStore{dataDir: dataDir}
+}
+
+func (s *fileCAStore) Get(ctx context.Context, databaseName, fingerprint string) ([]byte, error) {
+	cert, err := ioutil.ReadFile(s.path(databaseName, fingerprint))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, trace.NotFound("no cached CA cert for database %q fingerprint %q", databaseName, fingerprint)
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	return cert, nil
+}
+
+func (s *fileCAStore) Put(ctx context.Context, databaseName, fingerprint string, cert []byte) error {
+	dir := filepath.Join(s.dataDir, "cas", databaseName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	if err := ioutil.WriteFile(s.path(databaseName, fingerprint), cert, 0600); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	return nil
+}
+
+func (s *fileCAStore) List(ctx context.Context, databaseName string) ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(s.dataDir, "cas", databaseName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, trace.ConvertSystemError(err)
+	}
+	var fingerprints []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if ext != ".pem" {
+			continue
+		}
+		fingerprints = append(fingerprints, entry.Name()[:len(entry.Name())-len(ext)])
+	}
+	return fingerprints, nil
+}
+
+func (s *fileCAStore) Delete(ctx context.Context, databaseName, fingerprint string) error {
+	if err := os.Remove(s.path(databaseName, fingerprint)); err != nil && !os.IsNotExist(err) {
+		return trace.ConvertSystemError(err)
+	}
+	return nil
+}
+
+func (s *fileCAStore) path(databaseName, fingerprint string) string {
+	return filepath.Join(s.dataDir, "cas", databaseName, fingerprint+".pem")
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cassandra
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gravitational/trace"
+)
+
+// contactPool round-robins connection attempts across a Cassandra ring's
+// contact points, so a single types.Database entry configured with one or
+// a few addresses can reach the whole ring once it's been discovered. It
+// only hands out addresses; it does not retry a failed connection against
+// another contact point.
+type contactPool struct {
+	mu        sync.Mutex
+	addrs     []string
+	nextIndex int
+}
+
+// newContactPool seeds the pool with the statically configured contact
+// points for a database, which may be a single host:port or a
+// comma-separated list.
+func newContactPool(uri string) *contactPool {
+	addrs := strings.Split(uri, ",")
+	for i := range addrs {
+		addrs[i] = strings.TrimSpace(addrs[i])
+	}
+	return &contactPool{addrs: addrs}
+}
+
+// next returns the next contact point to try.
+func (p *contactPool) next() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.addrs) == 0 {
+		return "", trace.BadParameter("no Cassandra contact points configured")
+	}
+	addr := p.addrs[p.nextIndex%len(p.addrs)]
+	p.nextIndex++
+	return addr, nil
+}
+
+// update replaces the pool's contact points with peers discovered from the
+// ring, so future connections are spread across the whole cluster rather
+// than just the addresses in the static config.
+func (p *contactPool) update(peers []string) {
+	if len(peers) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.addrs = peers
+}
+
+// cassandraNativePort is the default port Cassandra listens on for the
+// native binary protocol. system.peers only records rpc_address, not the
+// port, since a ring conventionally uses the same native port everywhere.
+const cassandraNativePort = "9042"
+
+// discoverPeers queries system.peers over a connection that has already
+// completed the CQL handshake (see performStartup) and returns the ring's
+// other contact points as host:port addresses. It understands just enough
+// of the RESULT frame format to pull a single inet column out of each row,
+// which is all this query returns.
+func discoverPeers(conn net.Conn) ([]string, error) {
+	query := frame{
+		Version: cqlProtocolVersion,
+		Stream:  0x7f,
+		Opcode:  opcodeQuery,
+		Body:    encodeQueryBody("SELECT rpc_address FROM system.peers"),
+	}
+	if err := query.writeTo(conn); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	resp, err := readFrame(conn)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if resp.Opcode != opcodeResult {
+		return nil, trace.BadParameter("unexpected response opcode %v to system.peers query", resp.Opcode)
+	}
+	return parseInetRows(resp.Body)
+}
+
+// encodeQueryBody builds a minimal QUERY frame body for a statement with
+// no bound values: [long string query][short consistency=ONE][byte flags=0].
+func encodeQueryBody(query string) []byte {
+	body := make([]byte, 0, 4+len(query)+2+1)
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(query)))
+	body = append(body, length...)
+	body = append(body, []byte(query)...)
+	consistency := make([]byte, 2)
+	binary.BigEndian.PutUint16(consistency, 0x0001) // ONE
+	body = append(body, consistency...)
+	body = append(body, 0x00) // query flags
+	return body
+}
+
+// resultKindRows is the RESULT frame kind for a query that returned rows.
+const resultKindRows = uint32(0x0002)
+
+// parseInetRows parses the rows of a single-column [inet] RESULT frame
+// body produced by a query like "SELECT rpc_address FROM system.peers".
+// It does not attempt to parse the general CQL result-set format (column
+// specs for arbitrary types, paging state, etc.) since the discovery query
+// is fixed and always returns exactly this shape.
+func parseInetRows(body []byte) ([]string, error) {
+	if len(body) < 4 {
+		return nil, trace.BadParameter("truncated RESULT frame")
+	}
+	kind := binary.BigEndian.Uint32(body[:4])
+	body = body[4:]
+	if kind != resultKindRows {
+		return nil, trace.BadParameter("unexpected RESULT kind %v", kind)
+	}
+	// Metadata: flags, column count, keyspace/table/column names (global
+	// table spec form, which is what a single-table SELECT produces).
+	if len(body) < 8 {
+		return nil, trace.BadParameter("truncated RESULT metadata")
+	}
+	flags := binary.BigEndian.Uint32(body[:4])
+	columnCount := binary.BigEndian.Uint32(body[4:8])
+	body = body[8:]
+	const globalTablesSpec = uint32(0x0001)
+	if flags&globalTablesSpec != 0 {
+		var err error
+		if _, body, err = readShortString(body); err != nil { // keyspace
+			return nil, trace.Wrap(err)
+		}
+		if _, body, err = readShortString(body); err != nil { // table
+			return nil, trace.Wrap(err)
+		}
+	}
+	for i := uint32(0); i < columnCount; i++ {
+		var err error
+		if _, body, err = readShortString(body); err != nil { // column name
+			return nil, trace.Wrap(err)
+		}
+		if len(body) < 2 {
+			return nil, trace.BadParameter("truncated column spec")
+		}
+		body = body[2:] // option ID (expected 0x0010, inet)
+	}
+
+	if len(body) < 4 {
+		return nil, trace.BadParameter("truncated row count")
+	}
+	rowCount := binary.BigEndian.Uint32(body[:4])
+	body = body[4:]
+
+	addrs := make([]string, 0, rowCount)
+	for i := uint32(0); i < rowCount; i++ {
+		if len(body) < 4 {
+			return nil, trace.BadParameter("truncated row")
+		}
+		valueLen := int32(binary.BigEndian.Uint32(body[:4]))
+		body = body[4:]
+		if valueLen < 0 || len(body) < int(valueLen) {
+			return nil, trace.BadParameter("truncated inet value")
+		}
+		ip := net.IP(body[:valueLen])
+		body = body[valueLen:]
+		addrs = append(addrs, net.JoinHostPort(ip.String(), cassandraNativePort))
+	}
+	return addrs, nil
+}
+
+// readShortString reads a CQL [string]: a 2-byte length followed by that
+// many UTF-8 bytes.
+func readShortString(body []byte) (value string, rest []byte, err error) {
+	if len(body) < 2 {
+		return "", nil, trace.BadParameter("short CQL string")
+	}
+	length := binary.BigEndian.Uint16(body[:2])
+	body = body[2:]
+	if int(length) > len(body) {
+		return "", nil, trace.BadParameter("truncated CQL string")
+	}
+	return string(body[:length]), body[length:], nil
+}
@@ -0,0 +1,295 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cassandra
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gravitational/trace"
+	"github.com/jonboulle/clockwork"
+	"github.com/sirupsen/logrus"
+
+	"github.com/gravitational/teleport/lib/srv/db/common"
+)
+
+// Engine implements the Cassandra/CQL database access engine, proxying the
+// native binary protocol to an upstream Cassandra node after establishing
+// per-session mTLS and minting short-lived credentials, and emitting audit
+// events for data-manipulating requests.
+type Engine struct {
+	// Auth is used to mint per-session database credentials and TLS
+	// material for connecting to the upstream node.
+	Auth common.Auth
+	// Audit emits audit events for the session.
+	Audit common.Audit
+	// Context is the server closing context.
+	Context context.Context
+	// Clock is used to control time.
+	Clock clockwork.Clock
+	// Log is used for logging.
+	Log *logrus.Entry
+
+	// preparedMu guards prepared.
+	preparedMu sync.Mutex
+	// prepared maps a PREPARE request's stream ID to its query text for
+	// the lifetime of that request, so the RESULT frame the node sends in
+	// response (observed on the server->client path) can be correlated
+	// with the statement ID it assigns, and saved to sessionCtx.Statements
+	// for later EXECUTEs of it to be audited with their original query
+	// text rather than just an opaque ID.
+	prepared map[int16]string
+}
+
+// HandleConnection completes the client-facing CQL handshake, connects to
+// an upstream Cassandra node (authenticating with credentials minted by
+// Auth), and proxies CQL frames between them until either side closes the
+// connection.
+func (e *Engine) HandleConnection(ctx context.Context, sessionCtx *common.Session, clientConn net.Conn) error {
+	if err := handshakeClient(clientConn); err != nil {
+		return trace.Wrap(err)
+	}
+
+	serverConn, err := e.connect(ctx, sessionCtx)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	defer serverConn.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- e.proxyClientToServer(sessionCtx, clientConn, serverConn)
+	}()
+	go func() {
+		errCh <- e.proxyServerToClient(sessionCtx, serverConn, clientConn)
+	}()
+
+	select {
+	case err := <-errCh:
+		return trace.Wrap(err)
+	case <-ctx.Done():
+		return trace.Wrap(ctx.Err())
+	}
+}
+
+// connect dials one of the database's contact points, upgrades the
+// connection to mTLS, and authenticates to the node using short-lived
+// credentials minted by Auth. Each call builds its own contactPool from the
+// database URI and refreshes it via a dedicated discovery connection (see
+// refreshContactPool), which takes the pool's first address; the address
+// dialed is then the pool's second entry (wrapping around), so the choice
+// does not rotate from one connection to the next. The returned connection
+// has completed its CQL handshake and is ready to carry the live session.
+func (e *Engine) connect(ctx context.Context, sessionCtx *common.Session) (net.Conn, error) {
+	tlsConfig, err := e.Auth.GetTLSConfig(ctx, sessionCtx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	password, err := e.Auth.GetPassword(ctx, sessionCtx, sessionCtx.DatabaseUser)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	pool := newContactPool(sessionCtx.Database.GetURI())
+	e.refreshContactPool(pool, sessionCtx, tlsConfig, password)
+
+	addr, err := pool.next()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := performStartup(conn, sessionCtx.DatabaseUser, password); err != nil {
+		conn.Close()
+		return nil, trace.Wrap(err)
+	}
+	return conn, nil
+}
+
+// refreshContactPool discovers additional ring members via system.peers
+// and, if successful, updates pool to spread future connections across
+// the whole cluster. Discovery runs on its own short-lived connection
+// with its own STARTUP/AUTH handshake, entirely separate from the
+// connection connect ultimately hands to the live proxy loop: the real
+// client hasn't sent its own STARTUP yet at this point, so a raw QUERY
+// frame could never be safely interleaved onto that connection. Failures
+// are logged and ignored, since the statically configured contact points
+// still work without discovery.
+func (e *Engine) refreshContactPool(pool *contactPool, sessionCtx *common.Session, tlsConfig *tls.Config, password string) {
+	addr, err := pool.next()
+	if err != nil {
+		return
+	}
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		e.Log.WithError(err).Debug("Failed to open Cassandra discovery connection.")
+		return
+	}
+	defer conn.Close()
+
+	if err := performStartup(conn, sessionCtx.DatabaseUser, password); err != nil {
+		e.Log.WithError(err).Debug("Failed to authenticate Cassandra discovery connection.")
+		return
+	}
+	peers, err := discoverPeers(conn)
+	if err != nil {
+		e.Log.WithError(err).Debug("Failed to discover additional Cassandra contact points.")
+		return
+	}
+	pool.update(peers)
+}
+
+// proxyClientToServer forwards frames from the client to the upstream
+// node, auditing QUERY/PREPARE/BATCH requests as it goes.
+func (e *Engine) proxyClientToServer(sessionCtx *common.Session, clientConn, serverConn net.Conn) error {
+	for {
+		f, err := readFrame(clientConn)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		e.audit(sessionCtx, f)
+		if err := f.writeTo(serverConn); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
+// proxyServerToClient forwards frames from the upstream node back to the
+// client, watching for the RESULT response to a PREPARE request so a
+// later EXECUTE of it can be audited with its original query text.
+func (e *Engine) proxyServerToClient(sessionCtx *common.Session, serverConn, clientConn net.Conn) error {
+	for {
+		f, err := readFrame(serverConn)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		e.observeResponse(sessionCtx, f)
+		if err := f.writeTo(clientConn); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
+
+// audit emits an audit event for f if it's a statement-carrying opcode.
+// Bound values for EXECUTE/BATCH are never logged since they're redacted
+// by default; only the originating QUERY/PREPARE text and, for QUERY and
+// EXECUTE, the consistency level are recorded.
+func (e *Engine) audit(sessionCtx *common.Session, f *frame) {
+	switch f.Opcode {
+	case opcodeQuery, opcodePrepare:
+		extra := map[string]interface{}{
+			"keyspace": sessionCtx.DatabaseName,
+			"opcode":   f.Opcode,
+		}
+		var query string
+		var err error
+		if f.Opcode == opcodePrepare {
+			// A PREPARE body is just the [long string] query; unlike a
+			// QUERY body, it carries no consistency level.
+			query, _, err = readLongString(f.Body)
+		} else {
+			var consistency consistencyLevel
+			query, consistency, err = parseQueryBody(f.Body)
+			extra["consistency_level"] = consistency.String()
+		}
+		if err != nil {
+			e.Log.WithError(err).Debug("Failed to parse CQL query frame.")
+			return
+		}
+		if f.Opcode == opcodePrepare {
+			e.notePendingPrepare(f.Stream, query)
+		}
+		e.Audit.OnQuery(e.Context, sessionCtx, common.Query{
+			Query: query,
+			Extra: extra,
+		})
+	case opcodeExecute:
+		id, consistency, err := parseExecuteBody(f.Body)
+		if err != nil {
+			e.Log.WithError(err).Debug("Failed to parse CQL EXECUTE frame.")
+			return
+		}
+		query, ok := sessionCtx.Statements.Get(id)
+		if !ok {
+			query = fmt.Sprintf("EXECUTE <unknown prepared statement %v>", id)
+		}
+		e.Audit.OnQuery(e.Context, sessionCtx, common.Query{
+			Query: query,
+			Extra: map[string]interface{}{
+				"consistency_level": consistency.String(),
+				"keyspace":          sessionCtx.DatabaseName,
+				"opcode":            f.Opcode,
+			},
+		})
+	case opcodeBatch:
+		e.Audit.OnQuery(e.Context, sessionCtx, common.Query{
+			Query: "BATCH",
+			Extra: map[string]interface{}{
+				"keyspace": sessionCtx.DatabaseName,
+			},
+		})
+	}
+}
+
+// notePendingPrepare records query as the text of the PREPARE request just
+// sent on stream, so observeResponse can correlate it with the statement
+// ID the node assigns once its RESULT response comes back.
+func (e *Engine) notePendingPrepare(stream int16, query string) {
+	e.preparedMu.Lock()
+	defer e.preparedMu.Unlock()
+	if e.prepared == nil {
+		e.prepared = make(map[int16]string)
+	}
+	e.prepared[stream] = query
+}
+
+// takePendingPrepare returns and clears the query text previously noted
+// for stream, if any.
+func (e *Engine) takePendingPrepare(stream int16) (string, bool) {
+	e.preparedMu.Lock()
+	defer e.preparedMu.Unlock()
+	query, ok := e.prepared[stream]
+	delete(e.prepared, stream)
+	return query, ok
+}
+
+// observeResponse checks f against the streams notePendingPrepare is
+// tracking and, if f is the RESULT response to one of them, saves its
+// assigned statement ID and original query text to sessionCtx.Statements.
+// Errors (including f simply not being a PREPARE's response, e.g. an
+// ERROR frame for a PREPARE that failed) are logged at most and otherwise
+// ignored, since a failure here should never interrupt proxying.
+func (e *Engine) observeResponse(sessionCtx *common.Session, f *frame) {
+	query, ok := e.takePendingPrepare(f.Stream)
+	if !ok {
+		return
+	}
+	if f.Opcode != opcodeResult {
+		return
+	}
+	id, err := parsePreparedID(f.Body)
+	if err != nil {
+		e.Log.WithError(err).Debug("Failed to parse CQL PREPARE response.")
+		return
+	}
+	sessionCtx.Statements.Save(id, query)
+}
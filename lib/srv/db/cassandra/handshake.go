@@ -0,0 +1,110 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cassandra
+
+import (
+	"net"
+
+	"github.com/gravitational/trace"
+)
+
+// handshakeStreamID is the stream ID used for the synchronous STARTUP/AUTH
+// exchange performed before a connection is handed off to the application
+// protocol (proxying or peer discovery), where only one request is ever
+// in flight at a time.
+const handshakeStreamID = int16(0)
+
+// performStartup runs the CQL connection handshake on conn: it sends
+// STARTUP and, if the node challenges with AUTHENTICATE, completes SASL
+// PLAIN authentication using username/password. It returns once the node
+// has replied READY or AUTH_SUCCESS, i.e. once conn is ready to carry
+// either the live proxy session or a peer discovery query.
+func performStartup(conn net.Conn, username, password string) error {
+	startup := frame{
+		Version: cqlProtocolVersion,
+		Stream:  handshakeStreamID,
+		Opcode:  opcodeStartup,
+		Body:    encodeStartupBody(),
+	}
+	if err := startup.writeTo(conn); err != nil {
+		return trace.Wrap(err)
+	}
+	resp, err := readFrame(conn)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	switch resp.Opcode {
+	case opcodeReady:
+		return nil
+	case opcodeAuthenticate:
+		return trace.Wrap(authenticate(conn, username, password))
+	case opcodeError:
+		return trace.Wrap(decodeErrorBody(resp.Body))
+	default:
+		return trace.BadParameter("unexpected response opcode %v to STARTUP", resp.Opcode)
+	}
+}
+
+// authenticate completes the SASL PLAIN challenge a node issues in
+// response to STARTUP when it requires authentication.
+func authenticate(conn net.Conn, username, password string) error {
+	authResponse := frame{
+		Version: cqlProtocolVersion,
+		Stream:  handshakeStreamID,
+		Opcode:  opcodeAuthResponse,
+		Body:    encodeAuthResponseBody(username, password),
+	}
+	if err := authResponse.writeTo(conn); err != nil {
+		return trace.Wrap(err)
+	}
+	resp, err := readFrame(conn)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	switch resp.Opcode {
+	case opcodeAuthSuccess:
+		return nil
+	case opcodeError:
+		return trace.Wrap(decodeErrorBody(resp.Body))
+	default:
+		return trace.BadParameter("unexpected response opcode %v to AUTH_RESPONSE", resp.Opcode)
+	}
+}
+
+// handshakeClient completes the client-facing half of the CQL handshake:
+// it reads the client's own STARTUP frame and replies READY directly,
+// without challenging for credentials. By the time a connection reaches
+// this engine the client has already authenticated to Teleport (the mTLS
+// identity on the session), so re-running CQL password auth here would
+// only be checking whatever (often absent) database credentials the
+// client's driver happens to be configured with; the engine authenticates
+// to the upstream node separately using credentials minted by Auth.
+func handshakeClient(clientConn net.Conn) error {
+	req, err := readFrame(clientConn)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if req.Opcode != opcodeStartup {
+		return trace.BadParameter("expected STARTUP as the first CQL frame from the client, got opcode %v", req.Opcode)
+	}
+	ready := frame{
+		Version: req.Version | 0x80,
+		Stream:  req.Stream,
+		Opcode:  opcodeReady,
+	}
+	return trace.Wrap(ready.writeTo(clientConn))
+}
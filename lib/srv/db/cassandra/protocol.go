@@ -0,0 +1,291 @@
+/*
+Copyright 2021 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cassandra implements a database access engine for the Cassandra
+// Query Language (CQL) native binary protocol.
+package cassandra
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+
+	"github.com/gravitational/trace"
+)
+
+// opcode identifies the kind of a CQL frame body, as defined by the native
+// protocol spec.
+type opcode byte
+
+// Opcodes used by the subset of the native protocol this engine inspects.
+// The full opcode set is larger; unrecognized opcodes are proxied through
+// unexamined.
+const (
+	opcodeError        = opcode(0x00)
+	opcodeStartup      = opcode(0x01)
+	opcodeReady        = opcode(0x02)
+	opcodeAuthenticate = opcode(0x03)
+	opcodeQuery        = opcode(0x07)
+	opcodeResult       = opcode(0x08)
+	opcodePrepare      = opcode(0x09)
+	opcodeExecute      = opcode(0x0A)
+	opcodeAuthResponse = opcode(0x0F)
+	opcodeAuthSuccess  = opcode(0x10)
+	opcodeBatch        = opcode(0x0D)
+)
+
+// resultKindPrepared is the RESULT frame kind Cassandra uses to respond to
+// a PREPARE request, carrying the statement ID that later EXECUTE requests
+// reference.
+const resultKindPrepared = uint32(0x0004)
+
+// cqlProtocolVersion is the native protocol version this engine speaks to
+// upstream Cassandra nodes and advertises in STARTUP.
+const cqlProtocolVersion = byte(0x04)
+
+// frameHeaderLength is the size in bytes of a CQL native protocol frame
+// header: version, flags, stream (2 bytes for protocol v3+), opcode,
+// length.
+const frameHeaderLength = 9
+
+// maxFrameBodyLength bounds how large a frame body may claim to be in its
+// header. Without this, a corrupted length field (from either the client
+// or the upstream node) would make readFrame attempt a multi-gigabyte
+// allocation before reading a single byte of the actual body.
+const maxFrameBodyLength = 32 * 1024 * 1024
+
+// frame is a single CQL native protocol frame: a fixed header followed by
+// an opcode-specific body.
+type frame struct {
+	Version byte
+	Flags   byte
+	Stream  int16
+	Opcode  opcode
+	Body    []byte
+}
+
+// isResponse reports whether the frame came from the server (high bit of
+// the version byte is set on responses).
+func (f frame) isResponse() bool {
+	return f.Version&0x80 != 0
+}
+
+// readFrame reads a single frame from r.
+func readFrame(r io.Reader) (*frame, error) {
+	header := make([]byte, frameHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > maxFrameBodyLength {
+		return nil, trace.BadParameter("CQL frame body length %v exceeds maximum of %v", length, maxFrameBodyLength)
+	}
+	body := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	return &frame{
+		Version: header[0],
+		Flags:   header[1],
+		Stream:  int16(binary.BigEndian.Uint16(header[2:4])),
+		Opcode:  opcode(header[4]),
+		Body:    body,
+	}, nil
+}
+
+// writeTo serializes the frame back to the wire format and writes it to w.
+func (f frame) writeTo(w io.Writer) error {
+	header := make([]byte, frameHeaderLength)
+	header[0] = f.Version
+	header[1] = f.Flags
+	binary.BigEndian.PutUint16(header[2:4], uint16(f.Stream))
+	header[4] = byte(f.Opcode)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(f.Body)))
+	if _, err := w.Write(header); err != nil {
+		return trace.Wrap(err)
+	}
+	if _, err := w.Write(f.Body); err != nil {
+		return trace.Wrap(err)
+	}
+	return nil
+}
+
+// readLongString reads a CQL [long string]: a 4-byte length followed by
+// that many UTF-8 bytes.
+func readLongString(body []byte) (value string, rest []byte, err error) {
+	if len(body) < 4 {
+		return "", nil, trace.BadParameter("short CQL long string")
+	}
+	length := binary.BigEndian.Uint32(body[:4])
+	body = body[4:]
+	if uint32(len(body)) < length {
+		return "", nil, trace.BadParameter("truncated CQL long string")
+	}
+	return string(body[:length]), body[length:], nil
+}
+
+// readShort reads a CQL [short]: an unsigned 2-byte integer.
+func readShort(body []byte) (value uint16, rest []byte, err error) {
+	if len(body) < 2 {
+		return 0, nil, trace.BadParameter("short CQL short")
+	}
+	return binary.BigEndian.Uint16(body[:2]), body[2:], nil
+}
+
+// consistencyLevel is the CQL consistency level requested for a query.
+type consistencyLevel uint16
+
+// consistencyLevelNames maps well-known consistency levels to their
+// textual representation for audit logging.
+var consistencyLevelNames = map[consistencyLevel]string{
+	0x0000: "ANY",
+	0x0001: "ONE",
+	0x0002: "TWO",
+	0x0003: "THREE",
+	0x0004: "QUORUM",
+	0x0005: "ALL",
+	0x0006: "LOCAL_QUORUM",
+	0x0007: "EACH_QUORUM",
+	0x0008: "SERIAL",
+	0x0009: "LOCAL_SERIAL",
+	0x000A: "LOCAL_ONE",
+}
+
+func (c consistencyLevel) String() string {
+	if name, ok := consistencyLevelNames[c]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// encodeStartupBody builds the body of a STARTUP frame: a [string map] of
+// options. CQL_VERSION is the only option this engine sends.
+func encodeStartupBody() []byte {
+	return encodeStringMap(map[string]string{"CQL_VERSION": "3.0.0"})
+}
+
+// encodeStringMap encodes m as a CQL [string map]: a [short] count
+// followed by that many [string][string] key/value pairs.
+func encodeStringMap(m map[string]string) []byte {
+	body := make([]byte, 2)
+	binary.BigEndian.PutUint16(body, uint16(len(m)))
+	for k, v := range m {
+		body = append(body, encodeShortString(k)...)
+		body = append(body, encodeShortString(v)...)
+	}
+	return body
+}
+
+// encodeShortString encodes s as a CQL [string]: a [short] length followed
+// by that many UTF-8 bytes.
+func encodeShortString(s string) []byte {
+	out := make([]byte, 2+len(s))
+	binary.BigEndian.PutUint16(out, uint16(len(s)))
+	copy(out[2:], s)
+	return out
+}
+
+// encodeAuthResponseBody builds the body of an AUTH_RESPONSE frame
+// carrying a SASL PLAIN response for username/password, the mechanism
+// Cassandra's PasswordAuthenticator expects: an empty authzid, the
+// authentication identity, and the password, each separated by a NUL
+// byte.
+func encodeAuthResponseBody(username, password string) []byte {
+	token := []byte("\x00" + username + "\x00" + password)
+	body := make([]byte, 4, 4+len(token))
+	binary.BigEndian.PutUint32(body, uint32(len(token)))
+	return append(body, token...)
+}
+
+// decodeErrorBody extracts the error code and message from an ERROR frame
+// body: [int code][string message].
+func decodeErrorBody(body []byte) error {
+	if len(body) < 4 {
+		return trace.BadParameter("truncated CQL ERROR frame")
+	}
+	code := binary.BigEndian.Uint32(body[:4])
+	message, _, err := readShortString(body[4:])
+	if err != nil {
+		return trace.BadParameter("CQL ERROR 0x%04x (unparseable message)", code)
+	}
+	return trace.BadParameter("CQL ERROR 0x%04x: %v", code, message)
+}
+
+// parseQueryBody extracts the query string and consistency level from a
+// QUERY frame body: [long string query][short consistency][rest...].
+// Bound values, if any, live in the query parameters that follow and are
+// not parsed here since they're redacted by default rather than logged.
+func parseQueryBody(body []byte) (query string, consistency consistencyLevel, err error) {
+	query, rest, err := readLongString(body)
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	level, _, err := readShort(rest)
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	return query, consistencyLevel(level), nil
+}
+
+// readShortBytes reads a CQL [short bytes]: a 2-byte length followed by
+// that many raw bytes, used for prepared statement IDs.
+func readShortBytes(body []byte) (value []byte, rest []byte, err error) {
+	if len(body) < 2 {
+		return nil, nil, trace.BadParameter("short CQL short bytes")
+	}
+	length := binary.BigEndian.Uint16(body[:2])
+	body = body[2:]
+	if int(length) > len(body) {
+		return nil, nil, trace.BadParameter("truncated CQL short bytes")
+	}
+	return body[:length], body[length:], nil
+}
+
+// parsePreparedID extracts the prepared statement ID from the RESULT frame
+// a node sends in response to PREPARE: [int kind][short bytes id][metadata
+// ...]. The metadata that follows isn't parsed; only the ID is needed to
+// correlate a later EXECUTE with the PREPARE that produced it.
+func parsePreparedID(body []byte) (id string, err error) {
+	if len(body) < 4 {
+		return "", trace.BadParameter("truncated RESULT frame")
+	}
+	kind := binary.BigEndian.Uint32(body[:4])
+	if kind != resultKindPrepared {
+		return "", trace.BadParameter("unexpected RESULT kind %v for PREPARE response", kind)
+	}
+	idBytes, _, err := readShortBytes(body[4:])
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+// parseExecuteBody extracts the prepared statement ID and consistency
+// level an EXECUTE frame is running: [short bytes id][short consistency]
+// [rest...]. Bound values, like a QUERY frame's, are not parsed here.
+func parseExecuteBody(body []byte) (id string, consistency consistencyLevel, err error) {
+	idBytes, rest, err := readShortBytes(body)
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	level, _, err := readShort(rest)
+	if err != nil {
+		return "", 0, trace.Wrap(err)
+	}
+	return hex.EncodeToString(idBytes), consistencyLevel(level), nil
+}
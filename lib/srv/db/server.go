@@ -31,6 +31,7 @@ import (
 	"github.com/gravitational/teleport/lib/labels"
 	"github.com/gravitational/teleport/lib/services"
 	"github.com/gravitational/teleport/lib/srv"
+	"github.com/gravitational/teleport/lib/srv/db/cassandra"
 	"github.com/gravitational/teleport/lib/srv/db/common"
 	"github.com/gravitational/teleport/lib/srv/db/mongodb"
 	"github.com/gravitational/teleport/lib/srv/db/mysql"
@@ -71,6 +72,14 @@ type Config struct {
 	Auth common.Auth
 	// CADownloader automatically downloads root certs for cloud hosted databases.
 	CADownloader CADownloader
+	// CAStore persists downloaded CA certs so they can be shared by every
+	// db-service replica. Defaults to a filesystem store under DataDir if
+	// CAStoreEtcd is not set.
+	CAStore CAStore
+	// CAStoreEtcd, if set, configures CAStore to use etcd instead of the
+	// local filesystem, so replicas behind a load balancer don't each
+	// download and cache their own copy of a database's CA cert.
+	CAStoreEtcd *EtcdCAStoreConfig
 	// LockWatcher is a lock watcher.
 	LockWatcher *services.LockWatcher
 }
@@ -120,8 +129,18 @@ func (c *Config) CheckAndSetDefaults(ctx context.Context) (err error) {
 	if c.Server == nil {
 		return trace.BadParameter("missing Server")
 	}
+	if c.CAStore == nil {
+		if c.CAStoreEtcd != nil {
+			c.CAStore, err = NewEtcdCAStore(*c.CAStoreEtcd)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+		} else {
+			c.CAStore = NewFileCAStore(c.DataDir)
+		}
+	}
 	if c.CADownloader == nil {
-		c.CADownloader = NewRealDownloader(c.DataDir)
+		c.CADownloader = NewRealDownloader(c.CAStore)
 	}
 	if c.LockWatcher == nil {
 		return trace.BadParameter("missing LockWatcher")
@@ -431,6 +450,14 @@ func (s *Server) dispatch(sessionCtx *common.Session, streamWriter events.Stream
 			Clock:   s.cfg.Clock,
 			Log:     sessionCtx.Log,
 		}, nil
+	case defaults.ProtocolCassandra:
+		return &cassandra.Engine{
+			Auth:    s.cfg.Auth,
+			Audit:   audit,
+			Context: s.closeContext,
+			Clock:   s.cfg.Clock,
+			Log:     sessionCtx.Log,
+		}, nil
 	}
 	return nil, trace.BadParameter("unsupported database protocol %q",
 		sessionCtx.Database.GetProtocol())
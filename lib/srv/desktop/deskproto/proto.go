@@ -3,9 +3,9 @@ package deskproto
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"image"
 	"image/png"
+	"io"
 
 	"github.com/gravitational/trace"
 )
@@ -13,12 +13,24 @@ import (
 type MessageType byte
 
 const (
-	TypePNGFrame       = MessageType(2)
-	TypeMouseMove      = MessageType(3)
-	TypeMouseButton    = MessageType(4)
-	TypeKeyboardButton = MessageType(5)
+	TypePNGFrame         = MessageType(2)
+	TypeMouseMove        = MessageType(3)
+	TypeMouseButton      = MessageType(4)
+	TypeKeyboardButton   = MessageType(5)
+	TypeSessionStart     = MessageType(6)
+	TypeSessionEnd       = MessageType(7)
+	TypeClipboardData    = MessageType(8)
+	TypeClipboardRequest = MessageType(9)
+	TypeClientCodecs     = MessageType(10)
+	TypeFrameDelta       = MessageType(11)
 )
 
+// maxPayloadLength bounds how large a length-prefixed payload (a PNG body
+// or a FrameDelta payload) may claim to be. Without this, a peer could
+// send a 4-byte length field claiming gigabytes of data and force a huge
+// allocation before the actual bytes are even validated.
+const maxPayloadLength = 32 * 1024 * 1024
+
 type Message interface {
 	Encode() ([]byte, error)
 }
@@ -36,6 +48,18 @@ func Decode(buf []byte) (Message, error) {
 		return decodeMouseButton(buf)
 	case byte(TypeKeyboardButton):
 		return decodeKeyboardButton(buf)
+	case byte(TypeSessionStart):
+		return decodeSessionStart(buf)
+	case byte(TypeSessionEnd):
+		return decodeSessionEnd(buf)
+	case byte(TypeClipboardData):
+		return decodeClipboardData(buf)
+	case byte(TypeClipboardRequest):
+		return decodeClipboardRequest(buf)
+	case byte(TypeClientCodecs):
+		return decodeClientCodecs(buf)
+	case byte(TypeFrameDelta):
+		return decodeFrameDelta(buf)
 	default:
 		return nil, trace.BadParameter("unsupported desktop protocol message type %d", buf[0])
 	}
@@ -62,15 +86,39 @@ func (f PNGFrame) Encode() ([]byte, error) {
 	}); err != nil {
 		return nil, trace.Wrap(err)
 	}
-	if err := png.Encode(buf, f.Img); err != nil {
+	pngBuf := new(bytes.Buffer)
+	if err := png.Encode(pngBuf, f.Img); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint32(pngBuf.Len())); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	buf.Write(pngBuf.Bytes())
 	return buf.Bytes(), nil
 }
 
 func decodePNGFrame(buf []byte) (PNGFrame, error) {
-	// TODO: implement
-	return PNGFrame{}, errors.New("unimplemented")
+	var header struct {
+		Left, Top     uint32
+		Right, Bottom uint32
+		Length        uint32
+	}
+	r := bytes.NewReader(buf[1:])
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return PNGFrame{}, trace.Wrap(err)
+	}
+	if header.Length > maxPayloadLength {
+		return PNGFrame{}, trace.BadParameter("PNG frame body length %v exceeds maximum of %v", header.Length, maxPayloadLength)
+	}
+	body := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return PNGFrame{}, trace.Wrap(err)
+	}
+	img, err := png.Decode(bytes.NewReader(body))
+	if err != nil {
+		return PNGFrame{}, trace.Wrap(err)
+	}
+	return PNGFrame{Img: img}, nil
 }
 
 type MouseMove struct {
@@ -141,3 +189,269 @@ func decodeKeyboardButton(buf []byte) (KeyboardButton, error) {
 	err := binary.Read(bytes.NewReader(buf[1:]), binary.BigEndian, &k)
 	return k, trace.Wrap(err)
 }
+
+// SessionStart is the first message sent over the desktop protocol, and is
+// used to mark the beginning of a recording for playback purposes.
+type SessionStart struct {
+	Timestamp    uint64
+	Username     string
+	ClusterName  string
+	ScreenWidth  uint16
+	ScreenHeight uint16
+}
+
+func (s SessionStart) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(TypeSessionStart))
+	if err := binary.Write(buf, binary.BigEndian, s.Timestamp); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := writeString(buf, s.Username); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := writeString(buf, s.ClusterName); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, s.ScreenWidth); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, s.ScreenHeight); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSessionStart(buf []byte) (SessionStart, error) {
+	var s SessionStart
+	r := bytes.NewReader(buf[1:])
+	if err := binary.Read(r, binary.BigEndian, &s.Timestamp); err != nil {
+		return SessionStart{}, trace.Wrap(err)
+	}
+	var err error
+	if s.Username, err = readString(r); err != nil {
+		return SessionStart{}, trace.Wrap(err)
+	}
+	if s.ClusterName, err = readString(r); err != nil {
+		return SessionStart{}, trace.Wrap(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &s.ScreenWidth); err != nil {
+		return SessionStart{}, trace.Wrap(err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &s.ScreenHeight); err != nil {
+		return SessionStart{}, trace.Wrap(err)
+	}
+	return s, nil
+}
+
+// SessionEnd is the last message sent over the desktop protocol, and is used
+// to mark the end of a recording for playback purposes.
+type SessionEnd struct {
+	Timestamp uint64
+}
+
+func (s SessionEnd) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(TypeSessionEnd))
+	if err := binary.Write(buf, binary.BigEndian, s.Timestamp); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSessionEnd(buf []byte) (SessionEnd, error) {
+	var s SessionEnd
+	err := binary.Read(bytes.NewReader(buf[1:]), binary.BigEndian, &s.Timestamp)
+	return s, trace.Wrap(err)
+}
+
+// writeString writes a uint16-length-prefixed string to buf.
+func writeString(buf *bytes.Buffer, s string) error {
+	if len(s) > 0xffff {
+		return trace.BadParameter("string too long: %v bytes", len(s))
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(len(s))); err != nil {
+		return trace.Wrap(err)
+	}
+	buf.WriteString(s)
+	return nil
+}
+
+// readString reads a uint16-length-prefixed string from r.
+func readString(r io.Reader) (string, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", trace.Wrap(err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return string(data), nil
+}
+
+// ClipboardData carries a clipboard update in either direction. Format is
+// a MIME-like tag (e.g. "text/plain") identifying how Data should be
+// interpreted; callers are expected to filter on it, since by default only
+// text formats are allowed to cross the session boundary.
+type ClipboardData struct {
+	Format string
+	Data   []byte
+}
+
+func (c ClipboardData) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(TypeClipboardData))
+	if err := writeString(buf, c.Format); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(c.Data))); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	buf.Write(c.Data)
+	return buf.Bytes(), nil
+}
+
+func decodeClipboardData(buf []byte) (ClipboardData, error) {
+	r := bytes.NewReader(buf[1:])
+	format, err := readString(r)
+	if err != nil {
+		return ClipboardData{}, trace.Wrap(err)
+	}
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return ClipboardData{}, trace.Wrap(err)
+	}
+	if length > maxPayloadLength {
+		return ClipboardData{}, trace.BadParameter("clipboard data length %v exceeds maximum of %v", length, maxPayloadLength)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return ClipboardData{}, trace.Wrap(err)
+	}
+	return ClipboardData{Format: format, Data: data}, nil
+}
+
+// ClipboardRequest asks the other side to send the current contents of its
+// clipboard as a ClipboardData message.
+type ClipboardRequest struct{}
+
+func (c ClipboardRequest) Encode() ([]byte, error) {
+	return []byte{byte(TypeClipboardRequest)}, nil
+}
+
+func decodeClipboardRequest(buf []byte) (ClipboardRequest, error) {
+	return ClipboardRequest{}, nil
+}
+
+// CodecID identifies how a FrameDelta's Payload is encoded.
+type CodecID byte
+
+const (
+	// CodecRaw is uncompressed RGBA.
+	CodecRaw = CodecID(0)
+	// CodecZlibRGBA is RGBA compressed with zlib.
+	CodecZlibRGBA = CodecID(1)
+	// CodecDeltaXORLZ4 is the rect XORed against the receiver's own copy
+	// of the same rect from the previous frame, then compressed with
+	// LZ4. It's only meaningful to a receiver that maintains a
+	// framebuffer mirror, since decoding it requires the prior pixels.
+	CodecDeltaXORLZ4 = CodecID(2)
+)
+
+// ClientCodecs is sent once, early in a session, to tell the other side
+// which FrameDelta codecs this side knows how to decode. A FrameDelta
+// using a codec the peer didn't advertise must not be sent.
+type ClientCodecs struct {
+	Codecs []CodecID
+}
+
+func (c ClientCodecs) Encode() ([]byte, error) {
+	if len(c.Codecs) > 0xff {
+		return nil, trace.BadParameter("too many codecs: %v", len(c.Codecs))
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteByte(byte(TypeClientCodecs))
+	buf.WriteByte(byte(len(c.Codecs)))
+	for _, codec := range c.Codecs {
+		buf.WriteByte(byte(codec))
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeClientCodecs(buf []byte) (ClientCodecs, error) {
+	if len(buf) < 2 {
+		return ClientCodecs{}, trace.BadParameter("short ClientCodecs message")
+	}
+	count := int(buf[1])
+	if len(buf) < 2+count {
+		return ClientCodecs{}, trace.BadParameter("truncated ClientCodecs message")
+	}
+	codecs := make([]CodecID, count)
+	for i := 0; i < count; i++ {
+		codecs[i] = CodecID(buf[2+i])
+	}
+	return ClientCodecs{Codecs: codecs}, nil
+}
+
+// FrameDelta carries an update to a single dirty rectangle, encoded with
+// one of the negotiated CodecIDs. It replaces sending a standalone
+// PNGFrame for every bitmap update, since most updates only touch a small
+// rect and compress far better as a delta against the previous frame than
+// as an independently-encoded PNG.
+type FrameDelta struct {
+	Left, Top, Right, Bottom uint32
+	Codec                    CodecID
+	Payload                  []byte
+}
+
+func (f FrameDelta) Encode() ([]byte, error) {
+	type header struct {
+		Type          byte
+		Left, Top     uint32
+		Right, Bottom uint32
+		Codec         byte
+		Length        uint32
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, header{
+		Type:   byte(TypeFrameDelta),
+		Left:   f.Left,
+		Top:    f.Top,
+		Right:  f.Right,
+		Bottom: f.Bottom,
+		Codec:  byte(f.Codec),
+		Length: uint32(len(f.Payload)),
+	}); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	buf.Write(f.Payload)
+	return buf.Bytes(), nil
+}
+
+func decodeFrameDelta(buf []byte) (FrameDelta, error) {
+	var header struct {
+		Left, Top     uint32
+		Right, Bottom uint32
+		Codec         byte
+		Length        uint32
+	}
+	r := bytes.NewReader(buf[1:])
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return FrameDelta{}, trace.Wrap(err)
+	}
+	if header.Length > maxPayloadLength {
+		return FrameDelta{}, trace.BadParameter("frame delta payload length %v exceeds maximum of %v", header.Length, maxPayloadLength)
+	}
+	payload := make([]byte, header.Length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return FrameDelta{}, trace.Wrap(err)
+	}
+	return FrameDelta{
+		Left:    header.Left,
+		Top:     header.Top,
+		Right:   header.Right,
+		Bottom:  header.Bottom,
+		Codec:   CodecID(header.Codec),
+		Payload: payload,
+	}, nil
+}
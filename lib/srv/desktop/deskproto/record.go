@@ -0,0 +1,154 @@
+package deskproto
+
+import (
+	"context"
+	"io"
+	"time"
+
+	apievents "github.com/gravitational/teleport/api/types/events"
+	"github.com/gravitational/teleport/lib/events"
+
+	"github.com/gravitational/trace"
+)
+
+// Emitter is satisfied by a Teleport events.StreamWriter. It's the audit
+// sink a Recorder writes desktop recording events to; unlike a plain
+// io.Writer, each call produces a structured audit event that the audit
+// backend (and, on playback, a downloader re-reading the session) knows
+// how to make sense of.
+type Emitter interface {
+	EmitAuditEvent(ctx context.Context, event apievents.AuditEvent) error
+}
+
+// Recorder turns a stream of desktop protocol messages into a sequence of
+// DesktopRecording audit events, one per message, each carrying the delay
+// since the previous message so playback can reproduce the original
+// timing.
+type Recorder struct {
+	emitter Emitter
+	last    time.Time
+}
+
+// NewRecorder returns a Recorder that emits events through emitter.
+func NewRecorder(emitter Emitter) *Recorder {
+	return &Recorder{emitter: emitter}
+}
+
+// Record emits msg as a DesktopRecording audit event, with its delay set
+// to the time elapsed since the previous call to Record (0 for the first
+// message).
+func (r *Recorder) Record(ctx context.Context, msg Message) error {
+	now := time.Now()
+	var delay time.Duration
+	if !r.last.IsZero() {
+		delay = now.Sub(r.last)
+	}
+	r.last = now
+
+	encoded, err := msg.Encode()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+
+	return trace.Wrap(r.emitter.EmitAuditEvent(ctx, &apievents.DesktopRecording{
+		Metadata: apievents.Metadata{
+			Type: events.DesktopRecordingEvent,
+			Time: now,
+		},
+		Message:           encoded,
+		DelayMilliseconds: delay.Milliseconds(),
+	}))
+}
+
+// maxRecordedMessageLength bounds how large a single recorded message may
+// be. Decoder.Decode rejects a DesktopRecording event (which playback
+// treats as untrusted input) whose message is larger, before decoding it.
+const maxRecordedMessageLength = 32 * 1024 * 1024
+
+// EventSource supplies the DesktopRecording audit events that make up a
+// session recording, in the order Recorder originally emitted them. It's
+// satisfied by whatever reads a session's events back out of the audit
+// backend (e.g. a downloader streaming a completed session, or an
+// in-progress session's event stream).
+type EventSource interface {
+	// Next returns the next DesktopRecording event in the session. It
+	// returns io.EOF once the session is exhausted.
+	Next(ctx context.Context) (*apievents.DesktopRecording, error)
+}
+
+// Decoder reads a recording back out as a sequence of messages, each
+// paired with the delay that preceded it.
+type Decoder struct {
+	src EventSource
+}
+
+// NewDecoder returns a Decoder that reads DesktopRecording events from src.
+func NewDecoder(src EventSource) *Decoder {
+	return &Decoder{src: src}
+}
+
+// Decode reads the next message from the recording along with the delay
+// that should be observed before emitting it during playback. It returns
+// io.EOF when the recording is exhausted.
+func (d *Decoder) Decode(ctx context.Context) (Message, time.Duration, error) {
+	event, err := d.src.Next(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(event.Message) > maxRecordedMessageLength {
+		return nil, 0, trace.BadParameter("recorded message length %v exceeds maximum of %v", len(event.Message), maxRecordedMessageLength)
+	}
+	msg, err := Decode(event.Message)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	return msg, time.Duration(event.DelayMilliseconds) * time.Millisecond, nil
+}
+
+// Player walks a recording and re-emits its messages, preserving the
+// original timing between them (scaled by Speed).
+type Player struct {
+	dec   *Decoder
+	emit  func(Message) error
+	Speed float64
+}
+
+// NewPlayer returns a Player that reads a recording's events from src and
+// passes each decoded message to emit. Speed is a playback speed
+// multiplier; 1.0 reproduces the original timing, 2.0 plays back twice as
+// fast, etc. A Speed of 0 is treated as 1.0.
+func NewPlayer(src EventSource, emit func(Message) error, speed float64) *Player {
+	if speed <= 0 {
+		speed = 1.0
+	}
+	return &Player{
+		dec:   NewDecoder(src),
+		emit:  emit,
+		Speed: speed,
+	}
+}
+
+// Play walks the recording to completion, or until ctx is canceled.
+func (p *Player) Play(ctx context.Context) error {
+	for {
+		msg, delay, err := p.dec.Decode(ctx)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return trace.Wrap(err)
+		}
+
+		if delay > 0 {
+			select {
+			case <-time.After(time.Duration(float64(delay) / p.Speed)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if err := p.emit(msg); err != nil {
+			return trace.Wrap(err)
+		}
+	}
+}
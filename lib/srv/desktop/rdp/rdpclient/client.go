@@ -6,21 +6,47 @@ package rdpclient
 
 typedef void (*handleBitmap_callback)(int64_t, struct Bitmap);
 void handleBitmap_cgo(int64_t cp, struct Bitmap cb);
+
+typedef void (*handleClipboardData_callback)(int64_t, struct ClipboardData);
+void handleClipboardData_cgo(int64_t cp, struct ClipboardData cb);
 */
 import "C"
 import (
+	"context"
 	"image"
 	"log"
+	"strings"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/gravitational/trace"
 	"github.com/sirupsen/logrus"
 
+	"github.com/gravitational/teleport/lib/events"
 	"github.com/gravitational/teleport/lib/srv/desktop/deskproto"
 )
 
+// maxClipboardDataLen is the largest clipboard payload that will be
+// forwarded in either direction, to bound how much data an RDP session can
+// exfiltrate (or have injected into it) via the clipboard.
+const maxClipboardDataLen = 1024 * 1024
+
+// allowedClipboardFormats are the MIME-like format tags permitted to cross
+// the session boundary by default. Arbitrary binary formats (images,
+// files) are rejected even when clipboard sharing is enabled.
+var allowedClipboardFormats = map[string]bool{
+	"text/plain": true,
+}
+
+func clipboardFormatAllowed(format string) bool {
+	return allowedClipboardFormats[strings.ToLower(format)]
+}
+
 type Options struct {
+	// Context is used to scope the lifetime of audit events emitted through
+	// Recorder. Defaults to context.Background() if unset.
+	Context       context.Context
 	Addr          string
 	Username      string
 	Password      string
@@ -28,6 +54,19 @@ type Options struct {
 	ClientHeight  uint16
 	OutputMessage func(deskproto.Message) error
 	InputMessage  func() (deskproto.Message, error)
+	// ClusterName is the name of the Teleport cluster that this session
+	// belongs to, recorded in the SessionStart message for playback.
+	ClusterName string
+	// Recorder, if set, receives a copy of every message exchanged with the
+	// RDP server as a DesktopRecording audit event, so the session can be
+	// replayed later. It is typically backed by a Teleport
+	// events.StreamWriter.
+	Recorder events.StreamWriter
+	// AllowClipboard is an RBAC-derived toggle controlling whether
+	// clipboard data is allowed to flow between the client and the RDP
+	// server. Clipboard messages are dropped in both directions when this
+	// is false.
+	AllowClipboard bool
 }
 
 func (o Options) validate() error {
@@ -51,13 +90,47 @@ type Client struct {
 	clientRef int64
 	done      chan struct{}
 
+	// rec records every message exchanged with the RDP server for later
+	// playback, or is nil if opts.Recorder was not set.
+	rec *deskproto.Recorder
+
+	// fb mirrors the screen state the client has already been sent, used
+	// to compute FrameDelta updates instead of re-encoding every bitmap
+	// update as a standalone PNG.
+	fb *framebuffer
+
+	// codecsMu guards codecs.
+	codecsMu sync.RWMutex
+	// codecs is the set of FrameDelta codecs the client has advertised
+	// support for via a deskproto.ClientCodecs message. Until one is
+	// received, only CodecRaw deltas (and full PNGFrame keyframes) are
+	// sent.
+	codecs map[deskproto.CodecID]bool
+
 	toFree []unsafe.Pointer
 }
 
 func New(opts Options) (*Client, error) {
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
 	c := &Client{
-		opts: opts,
-		done: make(chan struct{}),
+		opts:   opts,
+		done:   make(chan struct{}),
+		fb:     newFramebuffer(int(opts.ClientWidth), int(opts.ClientHeight)),
+		codecs: map[deskproto.CodecID]bool{deskproto.CodecRaw: true},
+	}
+	if opts.Recorder != nil {
+		c.rec = deskproto.NewRecorder(opts.Recorder)
+		if err := c.rec.Record(opts.Context, deskproto.SessionStart{
+			Timestamp:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+			Username:     opts.Username,
+			ClusterName:  opts.ClusterName,
+			ScreenWidth:  opts.ClientWidth,
+			ScreenHeight: opts.ClientHeight,
+		}); err != nil {
+			return nil, trace.Wrap(err)
+		}
 	}
 	if err := c.connect(); err != nil {
 		return nil, trace.Wrap(err)
@@ -66,6 +139,19 @@ func New(opts Options) (*Client, error) {
 	return c, nil
 }
 
+// record emits msg as a DesktopRecording audit event, if a recording is in
+// progress. Errors are logged but not returned, matching the treatment of
+// other recording failures in the codebase: a broken recording should not
+// interrupt the interactive session.
+func (c *Client) record(msg deskproto.Message) {
+	if c.rec == nil {
+		return
+	}
+	if err := c.rec.Record(c.opts.Context, msg); err != nil {
+		logrus.Warningf("Failed to record RDP session message: %v", err)
+	}
+}
+
 func (c *Client) connect() error {
 	addr := cgoString(c.opts.Addr)
 	c.toFree = append(c.toFree, unsafe.Pointer(addr.data))
@@ -94,6 +180,12 @@ func (c *Client) run() {
 		C.int64_t(c.clientRef),
 		(*[0]byte)(unsafe.Pointer(C.handleBitmap_cgo)),
 	)
+	if c.opts.AllowClipboard {
+		go C.read_rdp_cliprdr(
+			C.int64_t(c.clientRef),
+			(*[0]byte)(unsafe.Pointer(C.handleClipboardData_cgo)),
+		)
+	}
 
 	var mouseX, mouseY uint32
 	for {
@@ -102,6 +194,7 @@ func (c *Client) run() {
 			logrus.Warningf("Failed reading RDP input message: %v", err)
 			return
 		}
+		c.record(msg)
 		switch m := msg.(type) {
 		case deskproto.MouseMove:
 			mouseX, mouseY = m.X, m.Y
@@ -142,6 +235,42 @@ func (c *Client) run() {
 					down: m.State == deskproto.ButtonPressed,
 				},
 			)
+		case deskproto.ClipboardData:
+			if !c.opts.AllowClipboard {
+				logrus.Warn("Rejected outbound clipboard data: clipboard sharing is disabled for this session.")
+				continue
+			}
+			if len(m.Data) > maxClipboardDataLen {
+				logrus.Warnf("Rejected outbound clipboard data: %v bytes exceeds limit of %v.", len(m.Data), maxClipboardDataLen)
+				continue
+			}
+			if !clipboardFormatAllowed(m.Format) {
+				logrus.Warnf("Rejected outbound clipboard data in unsupported format %q.", m.Format)
+				continue
+			}
+			data := C.CBytes(m.Data)
+			C.write_rdp_cliprdr(
+				C.int64_t(c.clientRef),
+				C.ClipboardData{
+					data_ptr: (*C.uint8_t)(data),
+					data_len: C.uint32_t(len(m.Data)),
+				},
+			)
+			C.free(data)
+		case deskproto.ClipboardRequest:
+			if !c.opts.AllowClipboard {
+				continue
+			}
+			C.write_rdp_cliprdr_request(C.int64_t(c.clientRef))
+		case deskproto.ClientCodecs:
+			codecs := make(map[deskproto.CodecID]bool, len(m.Codecs)+1)
+			codecs[deskproto.CodecRaw] = true
+			for _, codec := range m.Codecs {
+				codecs[codec] = true
+			}
+			c.codecsMu.Lock()
+			c.codecs = codecs
+			c.codecsMu.Unlock()
 		}
 	}
 }
@@ -157,20 +286,91 @@ func (c *Client) handleBitmap(cb C.Bitmap) {
 	for i := 0; i < len(data); i += 4 {
 		data[i], data[i+2] = data[i+2], data[i]
 	}
-	img := image.NewRGBA(image.Rectangle{
+	rect := image.Rectangle{
 		Min: image.Pt(int(cb.dest_left), int(cb.dest_top)),
 		Max: image.Pt(int(cb.dest_right)+1, int(cb.dest_bottom)+1),
-	})
-	copy(img.Pix, data)
+	}
+	if !c.fb.contains(rect) {
+		log.Printf("rejected out-of-bounds bitmap update %v for %vx%v screen", rect, c.fb.width, c.fb.height)
+		return
+	}
+
+	msg := c.encodeUpdate(rect, data)
+	c.record(msg)
+	if err := c.opts.OutputMessage(msg); err != nil {
+		log.Printf("failed to send desktop protocol message for %v: %v", rect, err)
+	}
+}
+
+// encodeUpdate picks how to send an update to rect: as a full PNGFrame for
+// a keyframe, i.e. any update covering the whole screen (or when no delta
+// encoding is worth sending), or
+// otherwise as a FrameDelta using whichever negotiated codec produces the
+// smallest payload.
+func (c *Client) encodeUpdate(rect image.Rectangle, pix []byte) deskproto.Message {
+	keyframe := c.fb.coversWholeScreen(rect)
+
+	var prevPix []byte
+	if !keyframe {
+		prevPix = c.fb.get(rect)
+	}
+	c.fb.put(rect, pix)
+
+	if !keyframe {
+		c.codecsMu.RLock()
+		codecs := c.codecs
+		c.codecsMu.RUnlock()
+
+		if codec, payload, ok := encodeDelta(codecs, prevPix, pix); ok {
+			return deskproto.FrameDelta{
+				Left:    uint32(rect.Min.X),
+				Top:     uint32(rect.Min.Y),
+				Right:   uint32(rect.Max.X),
+				Bottom:  uint32(rect.Max.Y),
+				Codec:   codec,
+				Payload: payload,
+			}
+		}
+	}
+
+	img := image.NewRGBA(rect)
+	copy(img.Pix, pix)
+	return deskproto.PNGFrame{Img: img}
+}
+
+//export handleClipboardDataJump
+func handleClipboardDataJump(ci C.int64_t, cb C.ClipboardData) {
+	findClient(int64(ci)).handleClipboardData(cb)
+}
 
-	if err := c.opts.OutputMessage(deskproto.PNGFrame{Img: img}); err != nil {
-		log.Printf("failed to send PNG frame %v: %v", img.Rect, err)
+// handleClipboardData is called by the Rust client whenever the remote
+// desktop's clipboard contents change. The callback carries no format tag,
+// so the data is forwarded labelled "text/plain" without a format check;
+// only AllowClipboard and maxClipboardDataLen limit what is forwarded.
+func (c *Client) handleClipboardData(cb C.ClipboardData) {
+	if !c.opts.AllowClipboard {
+		return
+	}
+	if uint32(cb.data_len) > maxClipboardDataLen {
+		log.Printf("Rejected inbound clipboard data: %v bytes exceeds limit of %v.", cb.data_len, maxClipboardDataLen)
+		return
+	}
+	data := C.GoBytes(unsafe.Pointer(cb.data_ptr), C.int(cb.data_len))
+
+	msg := deskproto.ClipboardData{Format: "text/plain", Data: data}
+	c.record(msg)
+	if err := c.opts.OutputMessage(msg); err != nil {
+		log.Printf("failed to send clipboard data: %v", err)
 	}
 }
 
 func (c *Client) Wait() error {
 	<-c.done
 
+	c.record(deskproto.SessionEnd{
+		Timestamp: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+	})
+
 	C.close_rdp(C.int64_t(c.clientRef))
 	unregisterClient(c.clientRef)
 	for _, ptr := range c.toFree {
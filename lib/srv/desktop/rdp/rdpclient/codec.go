@@ -0,0 +1,82 @@
+package rdpclient
+
+import (
+	"bytes"
+	"compress/zlib"
+
+	"github.com/gravitational/trace"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/gravitational/teleport/lib/srv/desktop/deskproto"
+)
+
+// deltaFallbackRatio bounds how much smaller than the raw pixels the best
+// available encoding must be before it's worth sending as a FrameDelta.
+// Below this, the rect is sent as a full PNGFrame instead, since PNG's
+// predictive filtering tends to do better than these codecs on
+// screen content that isn't mostly unchanged from the previous frame.
+const deltaFallbackRatio = 0.75
+
+// encodeDelta picks the smallest available encoding of newPix among the
+// codecs the client has advertised support for, optionally diffing against
+// prevPix (the framebuffer mirror's copy of the same rect from the
+// previous frame). It returns ok=false if none of the available encodings
+// are worth sending as a delta, in which case the caller should fall back
+// to a PNGFrame.
+func encodeDelta(codecs map[deskproto.CodecID]bool, prevPix, newPix []byte) (codec deskproto.CodecID, payload []byte, ok bool) {
+	best := deskproto.CodecRaw
+	bestPayload := newPix
+
+	if codecs[deskproto.CodecZlibRGBA] {
+		if compressed, err := zlibCompress(newPix); err == nil && len(compressed) < len(bestPayload) {
+			best = deskproto.CodecZlibRGBA
+			bestPayload = compressed
+		}
+	}
+
+	if codecs[deskproto.CodecDeltaXORLZ4] && prevPix != nil && len(prevPix) == len(newPix) {
+		diff := xorBytes(prevPix, newPix)
+		if compressed, err := lz4Compress(diff); err == nil && len(compressed) < len(bestPayload) {
+			best = deskproto.CodecDeltaXORLZ4
+			bestPayload = compressed
+		}
+	}
+
+	if float64(len(bestPayload)) > float64(len(newPix))*deltaFallbackRatio {
+		return 0, nil, false
+	}
+	return best, bestPayload, true
+}
+
+func zlibCompress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := zlib.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func lz4Compress(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := lz4.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// xorBytes returns a XORed with b. a and b must be the same length.
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
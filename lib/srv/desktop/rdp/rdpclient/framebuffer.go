@@ -0,0 +1,81 @@
+package rdpclient
+
+import (
+	"image"
+	"sync"
+)
+
+// framebuffer is a server-side mirror of the last pixels sent to the
+// client for each point on the screen. It lets handleBitmap compute a diff
+// against what the client should already have, instead of re-encoding
+// every update from scratch.
+type framebuffer struct {
+	mu            sync.Mutex
+	width, height int
+	// pix holds the mirrored screen as RGBA, row-major, 4 bytes/pixel.
+	pix []byte
+}
+
+func newFramebuffer(width, height int) *framebuffer {
+	return &framebuffer{
+		width:  width,
+		height: height,
+		pix:    make([]byte, width*height*4),
+	}
+}
+
+// contains reports whether rect falls entirely within the framebuffer's
+// bounds. get and put assume this has already been checked; callers must
+// validate untrusted rects (e.g. from an RDP server's Bitmap callback)
+// before passing them in.
+func (f *framebuffer) contains(rect image.Rectangle) bool {
+	return rect.Min.X >= 0 && rect.Min.Y >= 0 &&
+		rect.Max.X <= f.width && rect.Max.Y <= f.height &&
+		rect.Min.X < rect.Max.X && rect.Min.Y < rect.Max.Y
+}
+
+// get returns a copy of the mirrored pixels for rect, row-major RGBA. The
+// returned slice has len 4*rect.Dx()*rect.Dy(). rect must satisfy contains.
+func (f *framebuffer) get(rect image.Rectangle) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]byte, 4*rect.Dx()*rect.Dy())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		srcStart := (y*f.width + rect.Min.X) * 4
+		srcEnd := srcStart + rect.Dx()*4
+		dstStart := (y - rect.Min.Y) * rect.Dx() * 4
+		copy(out[dstStart:dstStart+rect.Dx()*4], f.pix[srcStart:srcEnd])
+	}
+	return out
+}
+
+// put overwrites the mirrored pixels for rect with pix, which should be
+// row-major RGBA with len 4*rect.Dx()*rect.Dy(). rect must satisfy
+// contains. pix falling short of that length is tolerated the same way
+// copy(dst, src) tolerates a short src: rows (or partial rows) beyond the
+// end of pix are simply left unchanged, rather than panicking.
+func (f *framebuffer) put(rect image.Rectangle, pix []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rowLen := rect.Dx() * 4
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		srcStart := (y - rect.Min.Y) * rowLen
+		if srcStart >= len(pix) {
+			break
+		}
+		srcEnd := srcStart + rowLen
+		if srcEnd > len(pix) {
+			srcEnd = len(pix)
+		}
+		dstStart := (y*f.width + rect.Min.X) * 4
+		copy(f.pix[dstStart:dstStart+rowLen], pix[srcStart:srcEnd])
+	}
+}
+
+// coversWholeScreen reports whether rect spans the entire mirrored screen,
+// which makes it a keyframe rather than an incremental update.
+func (f *framebuffer) coversWholeScreen(rect image.Rectangle) bool {
+	return rect.Min.X == 0 && rect.Min.Y == 0 && rect.Dx() == f.width && rect.Dy() == f.height
+}
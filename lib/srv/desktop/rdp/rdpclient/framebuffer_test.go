@@ -0,0 +1,55 @@
+package rdpclient
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFramebufferContains(t *testing.T) {
+	fb := newFramebuffer(100, 50)
+
+	cases := []struct {
+		name string
+		rect image.Rectangle
+		want bool
+	}{
+		{"whole screen", image.Rect(0, 0, 100, 50), true},
+		{"interior rect", image.Rect(10, 10, 20, 20), true},
+		{"negative origin", image.Rect(-1, 0, 10, 10), false},
+		{"exceeds width", image.Rect(90, 0, 101, 10), false},
+		{"exceeds height", image.Rect(0, 40, 10, 51), false},
+		{"empty rect", image.Rect(10, 10, 10, 10), false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := fb.contains(tc.rect); got != tc.want {
+				t.Errorf("contains(%v) = %v, want %v", tc.rect, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestFramebufferPutShortPix verifies that put tolerates a pix slice
+// shorter than the rect it's meant to cover instead of panicking, since
+// pix's length ultimately comes from an untrusted RDP server.
+func TestFramebufferPutShortPix(t *testing.T) {
+	fb := newFramebuffer(10, 10)
+	rect := image.Rect(0, 0, 10, 10)
+
+	short := make([]byte, 4) // a single pixel, not the 400 bytes rect needs
+	for i := range short {
+		short[i] = 0xFF
+	}
+
+	fb.put(rect, short) // must not panic
+
+	got := fb.get(rect)
+	if got[0] != 0xFF || got[1] != 0xFF || got[2] != 0xFF || got[3] != 0xFF {
+		t.Errorf("first pixel = %v, want all 0xFF", got[:4])
+	}
+	for _, b := range got[4:] {
+		if b != 0 {
+			t.Fatalf("expected bytes beyond the short pix to be left untouched (zero), got %v", got[4:20])
+		}
+	}
+}